@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	etcdCacert   = flag.String("etcd-cacert", "", "path to a PEM CA bundle used to verify the etcd server certificate")
+	etcdCert     = flag.String("etcd-cert", "", "path to a client certificate for etcd TLS authentication")
+	etcdKey      = flag.String("etcd-key", "", "path to the private key matching -etcd-cert")
+	etcdUser     = flag.String("etcd-user", "", "username for etcd authentication")
+	etcdPassword = flag.String("etcd-password", "", "password for etcd authentication")
+
+	sinkCacert = flag.String("sink-cacert", "", "path to a PEM CA bundle used to verify the sink server certificate")
+	sinkCert   = flag.String("sink-cert", "", "path to a client certificate for the sink TLS connection")
+	sinkKey    = flag.String("sink-key", "", "path to the private key matching -sink-cert")
+	sinkBearer = flag.String("sink-bearer", "", "path to a file containing a bearer token sent as the sink Authorization header; reloaded if the file changes")
+	sinkBasic  = flag.String("sink-basic", "", "user:pass sent as HTTP basic auth on every sink request")
+)
+
+// loadTLSConfig builds a *tls.Config from an optional CA bundle and an
+// optional client certificate/key pair. It returns nil if none of the paths
+// are set, preserving the default transport behavior.
+func loadTLSConfig(cacert, cert, key string) (*tls.Config, error) {
+	if cacert == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+
+	if cacert != "" {
+		pem, err := ioutil.ReadFile(cacert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle %s: %s", cacert, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cacert)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client cert/key: %s", err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return cfg, nil
+}
+
+// sinkAuth attaches authentication to outbound sink requests. A bearer token
+// is re-read from disk whenever the file's mtime changes so that rotating
+// JWTs don't require a restart.
+type sinkAuth struct {
+	mu          sync.Mutex
+	bearerPath  string
+	bearerToken string
+	bearerMtime int64
+
+	basicUser string
+	basicPass string
+}
+
+func newSinkAuth(bearerPath, basic string) *sinkAuth {
+	a := &sinkAuth{bearerPath: bearerPath}
+	if basic != "" {
+		parts := strings.SplitN(basic, ":", 2)
+		a.basicUser = parts[0]
+		if len(parts) > 1 {
+			a.basicPass = parts[1]
+		}
+	}
+	return a
+}
+
+func (a *sinkAuth) apply(req *http.Request) error {
+	if a.bearerPath != "" {
+		token, err := a.currentBearerToken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	if a.basicUser != "" {
+		req.SetBasicAuth(a.basicUser, a.basicPass)
+	}
+	return nil
+}
+
+func (a *sinkAuth) currentBearerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Stat(a.bearerPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat bearer file %s: %s", a.bearerPath, err.Error())
+	}
+
+	mtime := fi.ModTime().UnixNano()
+	if mtime != a.bearerMtime || a.bearerToken == "" {
+		buf, err := ioutil.ReadFile(a.bearerPath)
+		if err != nil {
+			return "", fmt.Errorf("cannot read bearer file %s: %s", a.bearerPath, err.Error())
+		}
+		a.bearerToken = strings.TrimSpace(string(buf))
+		a.bearerMtime = mtime
+	}
+
+	return a.bearerToken, nil
+}
+
+// sinkHTTPClient builds the *http.Client used for every outbound sink
+// request, with optional TLS verification/client-cert material wired in.
+func sinkHTTPClient() (*http.Client, error) {
+	tlsCfg, err := loadTLSConfig(*sinkCacert, *sinkCert, *sinkKey)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg == nil {
+		return &http.Client{}, nil
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsCfg}
+	return &http.Client{Transport: transport}, nil
+}
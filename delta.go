@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	ModeSnapshot = "snapshot"
+	ModeDelta    = "delta"
+	ModeBoth     = "both"
+)
+
+var (
+	mode            = flag.String("mode", ModeSnapshot, "emission mode: snapshot, delta, or both")
+	stateFile       = flag.String("state-file", "", "path used to persist the previous snapshot across restarts so delta mode doesn't resend everything as added")
+	fullResyncEvery = flag.Int("full-resync-every", 0, "in delta mode, send a full snapshot every N flushes as a correctness anchor (0 disables)")
+)
+
+// DeltaLeaf wraps a changed value together with the etcd ModRevision it was
+// observed at, so downstream consumers can order events.
+type DeltaLeaf struct {
+	Value       interface{} `json:"value"`
+	ModRevision int64       `json:"mod_revision"`
+}
+
+// Delta describes what changed between two snapshots of doc.
+type Delta struct {
+	Added    map[string]interface{} `json:"added"`
+	Modified map[string]interface{} `json:"modified"`
+	Deleted  []string               `json:"deleted"`
+}
+
+// State is what gets persisted to -state-file between flushes: the document
+// itself, plus which full keys were real etcd leaves at that point. The
+// latter is what lets diffNode tell a genuine doc subtree apart from a
+// "type: json" leaf whose value happens to unmarshal into a map.
+type State struct {
+	Doc       map[string]interface{} `json:"doc"`
+	Revisions map[string]int64       `json:"revisions"`
+}
+
+// diff walks prev and cur in lock-step and returns everything that was
+// added, modified, or deleted between them. prevRevisions/curRevisions map a
+// full etcd key (e.g. "/services/x/y") to the ModRevision it was last
+// written at, and double as the set of keys that are real leaves rather than
+// tree structure introduced by key-splitting.
+func diff(prev, cur map[string]interface{}, prevRevisions, curRevisions map[string]int64) *Delta {
+	d := &Delta{
+		Added:    make(map[string]interface{}),
+		Modified: make(map[string]interface{}),
+	}
+	diffNode(prev, cur, nil, prevRevisions, curRevisions, d.Added, d.Modified, &d.Deleted)
+	return d
+}
+
+func diffNode(prev, cur map[string]interface{}, prefix []string, prevRevisions, curRevisions map[string]int64, added, modified map[string]interface{}, deleted *[]string) {
+	for k, cv := range cur {
+		path := append(append([]string{}, prefix...), k)
+
+		if cm, ok := cv.(map[string]interface{}); ok && !isLeafKey(curRevisions, path) {
+			pm, _ := prev[k].(map[string]interface{})
+			childAdded := make(map[string]interface{})
+			childModified := make(map[string]interface{})
+			diffNode(pm, cm, path, prevRevisions, curRevisions, childAdded, childModified, deleted)
+			if len(childAdded) > 0 {
+				added[k] = childAdded
+			}
+			if len(childModified) > 0 {
+				modified[k] = childModified
+			}
+			continue
+		}
+
+		pv, existed := prev[k]
+		leaf := DeltaLeaf{Value: cv, ModRevision: curRevisions[fullKey(path)]}
+		if !existed {
+			added[k] = leaf
+		} else if !reflect.DeepEqual(pv, cv) {
+			modified[k] = leaf
+		}
+	}
+
+	for k, pv := range prev {
+		if _, ok := cur[k]; ok {
+			continue
+		}
+		path := append(append([]string{}, prefix...), k)
+		if pm, ok := pv.(map[string]interface{}); ok && !isLeafKey(prevRevisions, path) {
+			collectKeys(pm, path, prevRevisions, deleted)
+		} else {
+			*deleted = append(*deleted, fullKey(path))
+		}
+	}
+}
+
+// isLeafKey reports whether path was a real etcd key (as opposed to an
+// intermediate node introduced by splitting keys on "/") the last time
+// revisions was captured.
+func isLeafKey(revisions map[string]int64, path []string) bool {
+	_, ok := revisions[fullKey(path)]
+	return ok
+}
+
+// collectKeys appends the full key of every leaf under node to out, used to
+// enumerate a deleted subtree one leaf at a time. A node is only descended
+// into when it isn't itself a leaf key, so a "type: json" value that decoded
+// into a map is reported as a single deleted key rather than split apart.
+func collectKeys(node map[string]interface{}, prefix []string, revisions map[string]int64, out *[]string) {
+	for k, v := range node {
+		path := append(append([]string{}, prefix...), k)
+		if m, ok := v.(map[string]interface{}); ok && !isLeafKey(revisions, path) {
+			collectKeys(m, path, revisions, out)
+		} else {
+			*out = append(*out, fullKey(path))
+		}
+	}
+}
+
+func fullKey(path []string) string {
+	return "/" + strings.Join(path, "/")
+}
+
+func loadState(path string) (*State, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read state file %s: %s", path, err.Error())
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("cannot parse state file %s: %s", path, err.Error())
+	}
+	return state, nil
+}
+
+func saveState(path string, state *State) error {
+	if path == "" {
+		return nil
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
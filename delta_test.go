@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffAddedModifiedDeleted(t *testing.T) {
+	prev := map[string]interface{}{
+		"services": map[string]interface{}{
+			"x": map[string]interface{}{"port": "8080"},
+			"y": map[string]interface{}{"port": "9090"},
+		},
+	}
+	cur := map[string]interface{}{
+		"services": map[string]interface{}{
+			"x": map[string]interface{}{"port": "8081"},
+			"z": map[string]interface{}{"port": "7070"},
+		},
+	}
+	prevRevisions := map[string]int64{
+		"/services/x/port": 1,
+		"/services/y/port": 2,
+	}
+	curRevisions := map[string]int64{
+		"/services/x/port": 3,
+		"/services/z/port": 4,
+	}
+
+	got := diff(prev, cur, prevRevisions, curRevisions)
+
+	wantAdded := map[string]interface{}{
+		"services": map[string]interface{}{
+			"z": map[string]interface{}{
+				"port": DeltaLeaf{Value: "7070", ModRevision: 4},
+			},
+		},
+	}
+	wantModified := map[string]interface{}{
+		"services": map[string]interface{}{
+			"x": map[string]interface{}{
+				"port": DeltaLeaf{Value: "8081", ModRevision: 3},
+			},
+		},
+	}
+	wantDeleted := []string{"/services/y/port"}
+
+	if !reflect.DeepEqual(got.Added, wantAdded) {
+		t.Errorf("Added = %#v, want %#v", got.Added, wantAdded)
+	}
+	if !reflect.DeepEqual(got.Modified, wantModified) {
+		t.Errorf("Modified = %#v, want %#v", got.Modified, wantModified)
+	}
+	if !reflect.DeepEqual(got.Deleted, wantDeleted) {
+		t.Errorf("Deleted = %#v, want %#v", got.Deleted, wantDeleted)
+	}
+}
+
+// TestDiffJSONLeafNotSplit covers the case where a "type: json" rule decodes
+// an etcd value into a map[string]interface{} that happens to look just like
+// a subtree produced by key-splitting. It must be diffed as one leaf, not
+// exploded into per-field added/modified entries.
+func TestDiffJSONLeafNotSplit(t *testing.T) {
+	prev := map[string]interface{}{
+		"cfg": map[string]interface{}{"a": float64(1), "b": float64(2)},
+	}
+	cur := map[string]interface{}{
+		"cfg": map[string]interface{}{"a": float64(1), "b": float64(3)},
+	}
+	revisions := map[string]int64{"/cfg": 5}
+
+	got := diff(prev, cur, revisions, revisions)
+
+	wantModified := map[string]interface{}{
+		"cfg": DeltaLeaf{
+			Value:       map[string]interface{}{"a": float64(1), "b": float64(3)},
+			ModRevision: 5,
+		},
+	}
+
+	if !reflect.DeepEqual(got.Modified, wantModified) {
+		t.Errorf("Modified = %#v, want %#v", got.Modified, wantModified)
+	}
+	if len(got.Added) != 0 {
+		t.Errorf("Added = %#v, want empty", got.Added)
+	}
+	if len(got.Deleted) != 0 {
+		t.Errorf("Deleted = %#v, want empty", got.Deleted)
+	}
+}
+
+func TestDiffDeletedJSONLeafNotSplit(t *testing.T) {
+	prev := map[string]interface{}{
+		"cfg": map[string]interface{}{"a": float64(1), "b": float64(2)},
+	}
+	cur := map[string]interface{}{}
+	prevRevisions := map[string]int64{"/cfg": 5}
+
+	got := diff(prev, cur, prevRevisions, nil)
+
+	want := []string{"/cfg"}
+	if !reflect.DeepEqual(got.Deleted, want) {
+		t.Errorf("Deleted = %#v, want %#v", got.Deleted, want)
+	}
+}
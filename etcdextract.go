@@ -1,192 +1,516 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
-	"github.com/coreos/etcd/client"
-	"github.com/op/go-logging"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/sirupsen/logrus"
 )
 
-var log = logging.MustGetLogger("etcdextract")
-
-// Example format string. Everything except the message has a custom color
-// which is dependent on the log level. Many fields have a custom output
-// formatting too, eg. the time returns the hour down to the milli second.
-var format = logging.MustStringFormatter(
-	"%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level:.4s} %{id:03x}%{color:reset} %{message}",
-)
+var log = logrus.New()
 
 var (
 	debug        = flag.Bool("v", false, "verbose output")
 	etcdEndpoint = flag.String("e", "http://127.0.0.1:2379", "etcd endpoint")
+
+	watchRetryBaseDelay = flag.Duration("watch-retry-base-delay", time.Second, "base delay for exponential backoff when a root's initial read or watch stream fails and must be restarted")
+	watchRetryMaxDelay  = flag.Duration("watch-retry-max-delay", 30*time.Second, "upper bound on the backoff delay between watch restart attempts")
 )
 
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s DOC_ROOTS INTERVAL URL\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  DOC_ROOTS - comma-separated list of etcd roots to extract\n")
-	fmt.Fprintf(os.Stderr, "  INTERVAL  - interval in seconds to perform the extraction\n")
+	fmt.Fprintf(os.Stderr, "  INTERVAL  - flush cadence in seconds: how often the accumulated\n")
+	fmt.Fprintf(os.Stderr, "              watch state is posted to the destination URL\n")
 	fmt.Fprintf(os.Stderr, "  URL       - URL to post the JSON data to\n")
 	flag.PrintDefaults()
 }
 
 func main() {
 
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc)
-	go func() {
-		s := <-sc
-		ssig := s.(syscall.Signal)
-		log.Error("Signal received: %s", ssig.String())
-		os.Exit(128 + int(ssig))
-	}()
-
 	flag.Usage = Usage
 	flag.Parse()
 
+	log.SetFormatter(&logrus.JSONFormatter{})
+	if *debug {
+		log.SetLevel(logrus.DebugLevel)
+	}
+
 	if flag.NArg() != 3 {
 		Usage()
 		os.Exit(2)
-	} else {
-		docRoots := flag.Arg(0)
-		intervalStr := flag.Arg(1)
-		url := flag.Arg(2)
+	}
 
-		roots := strings.Split(docRoots, ",")
-		interval, err := strconv.Atoi(intervalStr)
-		if err != nil {
-			log.Fatal("Invalid interval value: %s", intervalStr)
-		}
+	docRoots := flag.Arg(0)
+	intervalStr := flag.Arg(1)
+	url := flag.Arg(2)
 
-		cfg := client.Config{
-			Endpoints: []string{*etcdEndpoint},
-			Transport: client.DefaultTransport,
-			// set timeout per request to fail fast when the target endpoint is unavailable
-			HeaderTimeoutPerRequest: 5 * time.Second,
-		}
-		c, err := client.New(cfg)
-		if err != nil {
-			log.Fatal(err)
-		}
-		kapi := client.NewKeysAPI(c)
+	roots := strings.Split(docRoots, ",")
+	interval, err := strconv.Atoi(intervalStr)
+	if err != nil {
+		log.Fatalf("Invalid interval value: %s", intervalStr)
+	}
+
+	etcdTLS, err := loadTLSConfig(*etcdCacert, *etcdCert, *etcdKey)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		for {
-			run(kapi, roots, url)
-			time.Sleep(time.Duration(interval) * time.Second)
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{*etcdEndpoint},
+		DialTimeout: 5 * time.Second,
+		TLS:         etcdTLS,
+		Username:    *etcdUser,
+		Password:    *etcdPassword,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	client, err = sinkHTTPClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth = newSinkAuth(*sinkBearer, *sinkBasic)
+
+	sink, err := newSink(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := loadTransformConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storeConfig(cfg)
+
+	serveMetrics(*metricsAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for s := range sc {
+			if s == syscall.SIGHUP {
+				reloadConfig()
+				continue
+			}
+			log.Errorf("Signal received: %s", s.(syscall.Signal).String())
+			cancel()
+			return
 		}
+	}()
+
+	run(ctx, c, roots, sink, time.Duration(interval)*time.Second)
+}
+
+// cfgBox lets a *TransformConfig, which may legitimately be nil, be swapped
+// atomically on SIGHUP without a lock on the read path.
+type cfgBox struct {
+	cfg *TransformConfig
+}
+
+var cfgHolder atomic.Value
 
+func storeConfig(cfg *TransformConfig) {
+	cfgHolder.Store(&cfgBox{cfg: cfg})
+}
+
+func currentConfig() *TransformConfig {
+	return cfgHolder.Load().(*cfgBox).cfg
+}
+
+// reloadConfig re-reads -config in response to SIGHUP. A bad config is
+// logged and ignored so a typo doesn't kill a running extractor.
+func reloadConfig() {
+	cfg, err := loadTransformConfig(*configPath)
+	if err != nil {
+		log.Errorf("config reload failed, keeping previous config: %s", err.Error())
+		return
 	}
+	storeConfig(cfg)
+	log.Info("config reloaded")
 }
 
 type Request struct {
 	Timestamp int64       `json:"timestamp"`
+	Kind      string      `json:"kind"`
 	Data      interface{} `json:"data"`
 }
 
-func run(kapi client.KeysAPI, roots []string, url string) {
+// auth and client are configured once in main and used by postJSON for every
+// outbound sink request.
+var (
+	auth   *sinkAuth
+	client = &http.Client{}
+)
+
+// run builds the initial document with a single Range per root, then opens a
+// Watch stream per root to keep the document up to date incrementally. Each
+// root is kept alive for the life of ctx by watchRootLoop, which re-Gets and
+// re-Watches with backoff if either step fails. The accumulated document is
+// flushed to url every flushInterval.
+func run(ctx context.Context, c *clientv3.Client, roots []string, sink Sink, flushInterval time.Duration) {
 	doc := make(map[string]interface{})
+	revisions := make(map[string]int64)
+	var mu sync.Mutex
+
+	watchCtx, stopWatches := context.WithCancel(ctx)
+	defer stopWatches()
+
 	for _, root := range roots {
-		ctx, _ := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
-		resp, err := kapi.Get(ctx, root, &client.GetOptions{Recursive: true})
+		go watchRootLoop(watchCtx, c, root, &doc, revisions, &mu)
+	}
+
+	prevState, err := loadState(*stateFile)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	flushCount := 0
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+
+			mu.Lock()
+			snapshot := copyDoc(doc)
+			curRevisions := make(map[string]int64, len(revisions))
+			for k, v := range revisions {
+				curRevisions[k] = v
+			}
+			mu.Unlock()
+
+			nodesTotal.Set(float64(len(curRevisions)))
+
+			flushCount++
+			prevState = flushOnce(ctx, sink, snapshot, prevState, curRevisions, flushCount)
+
+			extractDuration.Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// watchRootLoop keeps root's slice of doc current for the life of ctx. A
+// failure to load or watch root (a transient network blip, the server
+// compacting the revision a watch resumed from, the stream being cancelled,
+// ...) previously left that root frozen for the rest of the process; it now
+// retries both steps with exponential backoff, so the root self-heals the
+// way the old polling model did.
+func watchRootLoop(ctx context.Context, c *clientv3.Client, root string, doc *map[string]interface{}, revisions map[string]int64, mu *sync.Mutex) {
+	delay := *watchRetryBaseDelay
+
+	for {
+		rev, err := loadRoot(ctx, c, root, doc, revisions, mu)
 		if err != nil {
-			log.Error("Cannot get root: %s. Error: %s", root, err.Error())
+			if ctx.Err() != nil {
+				return
+			}
+			watchErrorsTotal.WithLabelValues(root).Inc()
+			log.Errorf("cannot read root %s, retrying in %s: %s", root, delay, err.Error())
+			if !sleepOrDone(ctx, delay) {
+				return
+			}
+			delay = nextWatchBackoff(delay)
+			continue
+		}
+		delay = *watchRetryBaseDelay
+
+		if err := watchRoot(ctx, c, root, rev, doc, revisions, mu); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			watchErrorsTotal.WithLabelValues(root).Inc()
+			log.Errorf("watch on root %s ended, restarting in %s: %s", root, delay, err.Error())
+			if !sleepOrDone(ctx, delay) {
+				return
+			}
+			delay = nextWatchBackoff(delay)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// loadRoot performs the initial Range over root, merges the results into
+// doc, and returns the revision a Watch should resume from.
+func loadRoot(ctx context.Context, c *clientv3.Client, root string, doc *map[string]interface{}, revisions map[string]int64, mu *sync.Mutex) (int64, error) {
+	getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	resp, err := c.Get(getCtx, root, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	mu.Lock()
+	for _, kv := range resp.Kvs {
+		outKey, rule, keep := transformKey(currentConfig(), string(kv.Key))
+		if !keep {
+			continue
+		}
+		merge(doc, outKey, transformValue(rule, kv.Value))
+		revisions[outKey] = kv.ModRevision
+	}
+	mu.Unlock()
+
+	return resp.Header.Revision + 1, nil
+}
+
+// watchRoot streams PUT/DELETE events for root starting at rev and mutates
+// doc and revisions in place as they arrive. It returns once the watch
+// stream ends, with a non-nil error unless that was because ctx is done.
+func watchRoot(ctx context.Context, c *clientv3.Client, root string, rev int64, doc *map[string]interface{}, revisions map[string]int64, mu *sync.Mutex) error {
+	wc := c.Watch(ctx, root, clientv3.WithPrefix(), clientv3.WithRev(rev))
+
+	var lastErr error
+	for resp := range wc {
+		if err := resp.Err(); err != nil {
+			lastErr = err
+			log.Errorf("Watch error on root %s: %s", root, err.Error())
 			continue
 		}
-		if resp.Node != nil {
-			merge(&doc, resp.Node)
+
+		mu.Lock()
+		for _, ev := range resp.Events {
+			outKey, rule, keep := transformKey(currentConfig(), string(ev.Kv.Key))
+			if !keep {
+				continue
+			}
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				merge(doc, outKey, transformValue(rule, ev.Kv.Value))
+				revisions[outKey] = ev.Kv.ModRevision
+			case clientv3.EventTypeDelete:
+				unset(doc, outKey)
+				delete(revisions, outKey)
+			}
 		}
+		mu.Unlock()
 	}
 
-	if url == "stdout://" {
-		buf, err := json.MarshalIndent(&Request{
-			Timestamp: time.Now().Unix(),
-			Data:      doc,
-		}, "", "  ")
-		if err != nil {
-			panic(err)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("watch stream for root %s closed", root)
+}
+
+// sleepOrDone waits for d, returning false early if ctx is done first.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// nextWatchBackoff doubles d, capped at -watch-retry-max-delay.
+func nextWatchBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > *watchRetryMaxDelay {
+		return *watchRetryMaxDelay
+	}
+	return d
+}
+
+// flushOnce emits one or more payloads for this tick according to -mode and
+// returns the state that should become the delta baseline for next time.
+func flushOnce(ctx context.Context, sink Sink, cur map[string]interface{}, prev *State, curRevisions map[string]int64, flushCount int) *State {
+	resync := *fullResyncEvery > 0 && flushCount%*fullResyncEvery == 0
+
+	var prevDoc map[string]interface{}
+	var prevRevisions map[string]int64
+	if prev != nil {
+		prevDoc = prev.Doc
+		prevRevisions = prev.Revisions
+	}
+
+	switch *mode {
+	case ModeDelta:
+		if prevDoc == nil || resync {
+			send(ctx, sink, ModeSnapshot, cur)
+		} else {
+			send(ctx, sink, ModeDelta, diff(prevDoc, cur, prevRevisions, curRevisions))
+		}
+	case ModeBoth:
+		send(ctx, sink, ModeSnapshot, cur)
+		if prevDoc != nil {
+			send(ctx, sink, ModeDelta, diff(prevDoc, cur, prevRevisions, curRevisions))
 		}
+	default:
+		send(ctx, sink, ModeSnapshot, cur)
+	}
 
-		fmt.Printf("%s\n", string(buf))
-	} else {
-		buf, err := json.Marshal(&Request{
-			Timestamp: time.Now().Unix(),
-			Data:      doc,
-		})
-		if err != nil {
-			panic(err)
+	if *mode == ModeDelta || *mode == ModeBoth {
+		newState := &State{Doc: cur, Revisions: curRevisions}
+		if err := saveState(*stateFile, newState); err != nil {
+			log.Error(err.Error())
 		}
+		return newState
+	}
+	return prev
+}
 
-		httpResp, err := http.Post(url, "application/json", bytes.NewReader(buf))
-		if err != nil {
-			log.Error("Cannot send HTTP request: %s", err.Error())
+func send(ctx context.Context, sink Sink, kind string, data interface{}) {
+	req := &Request{
+		Timestamp: time.Now().Unix(),
+		Kind:      kind,
+		Data:      data,
+	}
+
+	if err := sink.Send(ctx, req); err != nil {
+		log.Errorf("Cannot send payload to sink: %s", err.Error())
+	}
+}
+
+// copyDoc returns a structural deep copy of doc so the snapshot taken for a
+// flush isn't aliased to the tree still being mutated by watches. Unlike a
+// JSON marshal/unmarshal round-trip, this preserves the concrete Go types
+// (e.g. the int64 a "type: int" rule produces) instead of collapsing every
+// number to float64, which silently loses precision above 2^53.
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	return deepCopyMap(doc)
+}
+
+func deepCopyMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = deepCopyValue(v)
+	}
+	return out
+}
+
+// deepCopyValue copies v, recursing into the map/slice shapes transformValue
+// and merge can produce. Every other value (string, int64, bool, float64,
+// nil, ...) is immutable and is simply copied by value.
+func deepCopyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return deepCopyMap(t)
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = deepCopyValue(e)
 		}
+		return out
+	default:
+		return t
+	}
+}
 
-		if httpResp.StatusCode != 200 {
-			log.Error("Error received from the HTTP endpoint: %s", httpResp.Status)
-			defer httpResp.Body.Close()
-			errBuf, err := ioutil.ReadAll(httpResp.Body)
-			if err != nil {
-				log.Error("Error response: %s", string(errBuf))
-			}
+// merge splits key on "/" and stores value at the corresponding path inside
+// doc, creating intermediate maps as needed.
+func merge(doc *map[string]interface{}, key string, value interface{}) {
+	segments := segmentsOf(key)
+	if len(segments) == 0 {
+		return
+	}
+
+	d := navigate(doc, segments[:len(segments)-1], true)
+	if d != nil {
+		(*d)[segments[len(segments)-1]] = value
+	}
+}
+
+// unset removes key from doc and prunes any parent maps left empty by the
+// removal.
+func unset(doc *map[string]interface{}, key string) {
+	segments := segmentsOf(key)
+	if len(segments) == 0 {
+		return
+	}
+
+	parents := make([]*map[string]interface{}, len(segments))
+	d := doc
+	for i, s := range segments[:len(segments)-1] {
+		parents[i] = d
+		v, ok := (*d)[s]
+		if !ok {
+			return
+		}
+		p, ok := v.(map[string]interface{})
+		if !ok {
 			return
 		}
+		d = &p
+	}
+
+	leaf := segments[len(segments)-1]
+	if _, ok := (*d)[leaf]; !ok {
+		return
+	}
+	delete(*d, leaf)
+
+	for i := len(segments) - 2; i >= 0; i-- {
+		if len(*d) > 0 {
+			break
+		}
+		delete(*parents[i], segments[i])
+		d = parents[i]
 	}
 }
 
-func merge(doc *map[string]interface{}, node *client.Node) {
-	key := node.Key
-	segments := strings.Split(key, "/")
-
-	if len(segments) > 0 {
-		if segments[0] == "" {
-			var d *map[string]interface{} = doc
-			var prev string = ""
-			for _, s := range segments[1:] {
-				if s == "" {
-					break
-				}
-
-				if prev != "" {
-					v, ok := (*d)[prev]
-					if !ok {
-						n := make(map[string]interface{})
-						(*d)[prev] = n
-						d = &n
-					} else {
-						p, ok := v.(map[string]interface{})
-						if ok {
-							d = &p
-						} else {
-							n := make(map[string]interface{})
-							(*d)[prev] = n
-							d = &n
-						}
-					}
-				}
-				prev = s
+// navigate walks doc along segments, creating intermediate maps along the
+// way when create is true. It returns nil if a segment cannot be traversed.
+func navigate(doc *map[string]interface{}, segments []string, create bool) *map[string]interface{} {
+	d := doc
+	for _, s := range segments {
+		v, ok := (*d)[s]
+		if !ok {
+			if !create {
+				return nil
 			}
-
-			if node.Dir {
-				for _, n := range node.Nodes {
-					merge(doc, n)
-				}
-			} else {
-				if prev != "" {
-					(*d)[prev] = node.Value
-				}
+			n := make(map[string]interface{})
+			(*d)[s] = n
+			d = &n
+			continue
+		}
+		p, ok := v.(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil
 			}
+			n := make(map[string]interface{})
+			(*d)[s] = n
+			d = &n
+			continue
+		}
+		d = &p
+	}
+	return d
+}
+
+func segmentsOf(key string) []string {
+	parts := strings.Split(key, "/")
+	segments := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			segments = append(segments, p)
 		}
 	}
+	return segments
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnset(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  map[string]interface{}
+		key  string
+		want map[string]interface{}
+	}{
+		{
+			name: "removes a top-level leaf",
+			doc:  map[string]interface{}{"a": "1", "b": "2"},
+			key:  "/a",
+			want: map[string]interface{}{"b": "2"},
+		},
+		{
+			name: "prunes an empty parent left behind by the removal",
+			doc: map[string]interface{}{
+				"services": map[string]interface{}{
+					"x": map[string]interface{}{"y": "1"},
+				},
+			},
+			key:  "/services/x/y",
+			want: map[string]interface{}{},
+		},
+		{
+			name: "keeps a parent that still has other children",
+			doc: map[string]interface{}{
+				"services": map[string]interface{}{
+					"x": map[string]interface{}{"y": "1", "z": "2"},
+				},
+			},
+			key: "/services/x/y",
+			want: map[string]interface{}{
+				"services": map[string]interface{}{
+					"x": map[string]interface{}{"z": "2"},
+				},
+			},
+		},
+		{
+			name: "missing key is a no-op",
+			doc:  map[string]interface{}{"a": "1"},
+			key:  "/missing",
+			want: map[string]interface{}{"a": "1"},
+		},
+		{
+			name: "key under a non-map value is a no-op",
+			doc:  map[string]interface{}{"a": "1"},
+			key:  "/a/b",
+			want: map[string]interface{}{"a": "1"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := tc.doc
+			unset(&doc, tc.key)
+			if !reflect.DeepEqual(doc, tc.want) {
+				t.Errorf("unset(%q) = %#v, want %#v", tc.key, doc, tc.want)
+			}
+		})
+	}
+}
+
+// TestCopyDocPreservesInt64 guards against copyDoc round-tripping values
+// through JSON, which collapses int64 to float64 and loses precision above
+// 2^53 for a "type: int" value such as a snowflake ID or a nanosecond
+// timestamp.
+func TestCopyDocPreservesInt64(t *testing.T) {
+	const big = int64(9007199254740993) // 2^53 + 1
+
+	doc := map[string]interface{}{
+		"a": big,
+		"nested": map[string]interface{}{
+			"b": big,
+		},
+	}
+
+	got := copyDoc(doc)
+
+	if v := got["a"]; v != big {
+		t.Errorf("got[\"a\"] = %#v, want %d", v, big)
+	}
+	nested, ok := got["nested"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("got[\"nested\"] is %T, want map[string]interface{}", got["nested"])
+	}
+	if v := nested["b"]; v != big {
+		t.Errorf("got[\"nested\"][\"b\"] = %#v, want %d", v, big)
+	}
+}
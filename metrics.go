@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr = flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. :9110; empty disables the metrics endpoint")
+
+var (
+	extractDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "etcdextract_extract_duration_seconds",
+		Help: "Time spent building and flushing one snapshot/delta cycle.",
+	})
+	nodesTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "etcdextract_nodes_total",
+		Help: "Number of leaf nodes currently held in memory across all roots.",
+	})
+	sinkErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcdextract_sink_errors_total",
+		Help: "Number of failed sink delivery attempts, by error code.",
+	}, []string{"code"})
+	lastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "etcdextract_last_success_timestamp",
+		Help: "Unix timestamp of the last successful sink delivery.",
+	})
+	watchErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcdextract_watch_errors_total",
+		Help: "Number of times a root's initial read or watch stream failed and had to be restarted, by root.",
+	}, []string{"root"})
+)
+
+func init() {
+	prometheus.MustRegister(extractDuration, nodesTotal, sinkErrorsTotal, lastSuccessTimestamp, watchErrorsTotal)
+}
+
+// serveMetrics starts the Prometheus HTTP endpoint in the background if addr
+// is non-empty.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("metrics server stopped: %s", err.Error())
+		}
+	}()
+}
+
+// SinkError carries a short machine-readable code (an HTTP status, or a
+// class like "transport") alongside the underlying error, for labeling
+// etcdextract_sink_errors_total.
+type SinkError struct {
+	Code string
+	Err  error
+}
+
+func (e *SinkError) Error() string {
+	return e.Err.Error()
+}
+
+func recordSinkError(err error) {
+	code := "error"
+	if se, ok := err.(*SinkError); ok {
+		code = se.Code
+	}
+	sinkErrorsTotal.WithLabelValues(code).Inc()
+}
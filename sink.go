@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	retryMax       = flag.Int("retry-max", 5, "maximum number of retries before a payload is spooled or dropped")
+	retryBaseDelay = flag.Duration("retry-base-delay", 500*time.Millisecond, "base delay for exponential backoff between sink retries")
+	spoolDir       = flag.String("spool-dir", "", "directory used to spool payloads that a sink could not accept after all retries; drained once the sink recovers")
+	spoolMax       = flag.Int("spool-max-entries", 10000, "maximum number of payloads kept in -spool-dir; oldest are dropped once exceeded")
+)
+
+// Sink delivers an extraction payload to a destination.
+type Sink interface {
+	Send(ctx context.Context, req *Request) error
+}
+
+// SinkFactory builds a Sink from the destination URL.
+type SinkFactory func(u *url.URL) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{}
+
+func registerSink(scheme string, f SinkFactory) {
+	sinkFactories[scheme] = f
+}
+
+func init() {
+	registerSink("http", newHTTPSink)
+	registerSink("https", newHTTPSink)
+	registerSink("stdout", newStdoutSink)
+	registerSink("file", newFileSink)
+	registerSink("kafka", newKafkaSink)
+	registerSink("nats", newNatsSink)
+}
+
+// newSink parses rawurl and builds the Sink registered for its scheme,
+// wrapped with retry/backoff and, if -spool-dir is set, disk-backed spooling.
+func newSink(rawurl string) (Sink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink URL %s: %s", rawurl, err.Error())
+	}
+
+	f, ok := sinkFactories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sink scheme: %s", u.Scheme)
+	}
+
+	inner, err := f(u)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := newSpool(*spoolDir, *spoolMax)
+	if err != nil {
+		return nil, err
+	}
+
+	return &retrySink{
+		inner:      inner,
+		maxRetries: *retryMax,
+		baseDelay:  *retryBaseDelay,
+		spool:      sp,
+	}, nil
+}
+
+// retrySink wraps a Sink with exponential backoff and jitter. When every
+// retry is exhausted and a spool directory is configured, the payload is
+// appended there instead of being silently dropped.
+type retrySink struct {
+	inner      Sink
+	maxRetries int
+	baseDelay  time.Duration
+	spool      *spool
+}
+
+func (r *retrySink) Send(ctx context.Context, req *Request) error {
+	delay := r.baseDelay
+	var err error
+
+	for attempt := 0; attempt <= r.maxRetries; attempt++ {
+		err = r.inner.Send(ctx, req)
+		if err == nil {
+			lastSuccessTimestamp.SetToCurrentTime()
+			if r.spool != nil {
+				r.spool.drain(ctx, r.inner.Send)
+			}
+			return nil
+		}
+
+		recordSinkError(err)
+		log.Errorf("sink send failed (attempt %d/%d): %s", attempt+1, r.maxRetries+1, err.Error())
+		if attempt == r.maxRetries {
+			break
+		}
+
+		jitter := time.Duration(rand.Int63n(int64(delay) + 1))
+		select {
+		case <-time.After(delay + jitter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+
+	if r.spool == nil {
+		return err
+	}
+
+	if serr := r.spool.push(req); serr != nil {
+		log.Errorf("cannot spool payload: %s", serr.Error())
+		return err
+	}
+	return nil
+}
+
+// httpSink is the original behavior: a plain JSON POST, now going through a
+// shared *http.Client with optional TLS and auth (see auth.go).
+type httpSink struct {
+	url string
+}
+
+func newHTTPSink(u *url.URL) (Sink, error) {
+	return &httpSink{url: u.String()}, nil
+}
+
+func (s *httpSink) Send(ctx context.Context, req *Request) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", s.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if auth != nil {
+		if err := auth.apply(httpReq); err != nil {
+			return err
+		}
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return &SinkError{Code: "transport", Err: err}
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != 200 {
+		errBuf, _ := ioutil.ReadAll(httpResp.Body)
+		return &SinkError{
+			Code: strconv.Itoa(httpResp.StatusCode),
+			Err:  fmt.Errorf("%s: %s", httpResp.Status, string(errBuf)),
+		}
+	}
+	return nil
+}
+
+// stdoutSink prints the payload as indented JSON, for local debugging.
+type stdoutSink struct{}
+
+func newStdoutSink(u *url.URL) (Sink, error) {
+	return &stdoutSink{}, nil
+}
+
+func (s *stdoutSink) Send(ctx context.Context, req *Request) error {
+	buf, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", string(buf))
+	return nil
+}
+
+// fileSink appends each payload as a single NDJSON line.
+type fileSink struct {
+	path string
+}
+
+func newFileSink(u *url.URL) (Sink, error) {
+	path := u.Path
+	if path == "" {
+		path = u.Host
+	}
+	if path == "" {
+		return nil, fmt.Errorf("file sink requires a path, e.g. file:///var/log/etcdextract.ndjson")
+	}
+	return &fileSink{path: path}, nil
+}
+
+func (s *fileSink) Send(ctx context.Context, req *Request) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(buf, '\n'))
+	return err
+}
+
+// kafkaSink produces each payload to a topic as a single message.
+type kafkaSink struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func newKafkaSink(u *url.URL) (Sink, error) {
+	topic := u.Path
+	if len(topic) > 0 && topic[0] == '/' {
+		topic = topic[1:]
+	}
+	if u.Host == "" || topic == "" {
+		return nil, fmt.Errorf("kafka sink URL must be kafka://broker[,broker...]/topic")
+	}
+
+	cfg := sarama.NewConfig()
+	cfg.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(strings.Split(u.Host, ","), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to kafka brokers %s: %s", u.Host, err.Error())
+	}
+
+	return &kafkaSink{producer: producer, topic: topic}, nil
+}
+
+func (s *kafkaSink) Send(ctx context.Context, req *Request) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.topic,
+		Value: sarama.ByteEncoder(buf),
+	})
+	return err
+}
+
+// natsSink publishes each payload to a subject.
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNatsSink(u *url.URL) (Sink, error) {
+	subject := u.Path
+	if len(subject) > 0 && subject[0] == '/' {
+		subject = subject[1:]
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("nats sink URL must be nats://broker/subject")
+	}
+
+	conn, err := nats.Connect(fmt.Sprintf("nats://%s", u.Host))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to nats broker %s: %s", u.Host, err.Error())
+	}
+
+	return &natsSink{conn: conn, subject: subject}, nil
+}
+
+func (s *natsSink) Send(ctx context.Context, req *Request) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return s.conn.Publish(s.subject, buf)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// failNTimesSink fails its first n Send calls, then succeeds.
+type failNTimesSink struct {
+	n     int
+	calls int
+}
+
+func (s *failNTimesSink) Send(ctx context.Context, req *Request) error {
+	s.calls++
+	if s.calls <= s.n {
+		return fmt.Errorf("simulated failure %d", s.calls)
+	}
+	return nil
+}
+
+func TestRetrySinkSucceedsWithinRetryBudget(t *testing.T) {
+	inner := &failNTimesSink{n: 2}
+	r := &retrySink{inner: inner, maxRetries: 3, baseDelay: time.Millisecond}
+
+	if err := r.Send(context.Background(), &Request{}); err != nil {
+		t.Fatalf("Send() = %s, want nil", err.Error())
+	}
+	if inner.calls != 3 {
+		t.Errorf("inner.calls = %d, want 3 (2 failures + 1 success)", inner.calls)
+	}
+}
+
+func TestRetrySinkSpoolsAfterExhaustingRetries(t *testing.T) {
+	inner := &failNTimesSink{n: 100}
+	sp, err := newSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &retrySink{inner: inner, maxRetries: 2, baseDelay: time.Millisecond, spool: sp}
+
+	if err := r.Send(context.Background(), &Request{Timestamp: 42}); err != nil {
+		t.Fatalf("Send() = %s, want nil (failure should be absorbed by the spool)", err.Error())
+	}
+	if want := 3; inner.calls != want {
+		t.Errorf("inner.calls = %d, want %d (1 initial attempt + 2 retries)", inner.calls, want)
+	}
+
+	lines, err := sp.readLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("spool has %d entries, want 1", len(lines))
+	}
+	if got := timestamps(t, lines); got[0] != 42 {
+		t.Errorf("spooled request timestamp = %d, want 42", got[0])
+	}
+}
+
+func TestRetrySinkReturnsErrorWithoutSpool(t *testing.T) {
+	inner := &failNTimesSink{n: 100}
+	r := &retrySink{inner: inner, maxRetries: 1, baseDelay: time.Millisecond}
+
+	if err := r.Send(context.Background(), &Request{}); err == nil {
+		t.Fatal("Send() = nil, want an error since there is no spool to fall back to")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const spoolFileName = "spool.ndjson"
+
+// spool is a bounded, disk-backed FIFO ring buffer of payloads that could
+// not be delivered after every retry. It is drained in order once the sink
+// recovers, so a sink outage doesn't lose etcd state changes.
+type spool struct {
+	dir        string
+	maxEntries int
+	mu         sync.Mutex
+}
+
+func newSpool(dir string, maxEntries int) (*spool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, maxEntries: maxEntries}, nil
+}
+
+func (s *spool) path() string {
+	return filepath.Join(s.dir, spoolFileName)
+}
+
+func (s *spool) push(req *Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return s.truncateToLimit()
+}
+
+// truncateToLimit drops the oldest entries once the spool grows past
+// maxEntries. Callers must hold s.mu.
+func (s *spool) truncateToLimit() error {
+	if s.maxEntries <= 0 {
+		return nil
+	}
+
+	lines, err := s.readLines()
+	if err != nil || len(lines) <= s.maxEntries {
+		return err
+	}
+
+	dropped := len(lines) - s.maxEntries
+	log.Errorf("spool %s exceeded %d entries, dropping %d oldest payloads", s.dir, s.maxEntries, dropped)
+	return s.writeLines(lines[dropped:])
+}
+
+func (s *spool) readLines() ([]string, error) {
+	buf, err := ioutil.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, l := range strings.Split(string(buf), "\n") {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+func (s *spool) writeLines(lines []string) error {
+	tmp := s.path() + ".tmp"
+	buf := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		buf += "\n"
+	}
+	if err := ioutil.WriteFile(tmp, []byte(buf), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path())
+}
+
+// drain attempts to resend every spooled payload, in order, via send. It
+// stops at the first failure and leaves the remaining (undelivered) entries
+// in the spool for the next attempt.
+func (s *spool) drain(ctx context.Context, send func(ctx context.Context, req *Request) error) {
+	s.mu.Lock()
+	lines, err := s.readLines()
+	s.mu.Unlock()
+	if err != nil || len(lines) == 0 {
+		return
+	}
+
+	for i, line := range lines {
+		var req Request
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			log.Errorf("dropping unreadable spool entry: %s", err.Error())
+			continue
+		}
+
+		if err := send(ctx, &req); err != nil {
+			s.mu.Lock()
+			s.writeLines(lines[i:])
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	s.mu.Lock()
+	os.Remove(s.path())
+	s.mu.Unlock()
+}
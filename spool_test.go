@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func timestamps(t *testing.T, lines []string) []int64 {
+	t.Helper()
+	out := make([]int64, len(lines))
+	for i, l := range lines {
+		var req Request
+		if err := json.Unmarshal([]byte(l), &req); err != nil {
+			t.Fatalf("cannot unmarshal spool entry %q: %s", l, err.Error())
+		}
+		out[i] = req.Timestamp
+	}
+	return out
+}
+
+func TestSpoolTruncateToLimitDropsOldest(t *testing.T) {
+	sp, err := newSpool(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 5; i++ {
+		if err := sp.push(&Request{Timestamp: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines, err := sp.readLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := timestamps(t, lines)
+	want := []int64{2, 3, 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("spooled timestamps = %v, want %v (oldest entries should be dropped first)", got, want)
+	}
+}
+
+func TestSpoolDrainStopsAtFirstFailureAndRequeuesRemainder(t *testing.T) {
+	sp, err := newSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 3; i++ {
+		if err := sp.push(&Request{Timestamp: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sent []int64
+	send := func(ctx context.Context, req *Request) error {
+		if req.Timestamp == 1 {
+			return fmt.Errorf("simulated sink failure")
+		}
+		sent = append(sent, req.Timestamp)
+		return nil
+	}
+
+	sp.drain(context.Background(), send)
+
+	if want := []int64{0}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent = %v, want %v", sent, want)
+	}
+
+	lines, err := sp.readLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(timestamps(t, lines), want) {
+		t.Errorf("remaining spool = %v, want %v", timestamps(t, lines), want)
+	}
+}
+
+func TestSpoolDrainClearsSpoolOnFullSuccess(t *testing.T) {
+	sp, err := newSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 2; i++ {
+		if err := sp.push(&Request{Timestamp: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send := func(ctx context.Context, req *Request) error { return nil }
+	sp.drain(context.Background(), send)
+
+	lines, err := sp.readLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("spool still has %d entries after a fully successful drain, want 0", len(lines))
+	}
+}
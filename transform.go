@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configPath = flag.String("config", "", "path to a YAML/JSON transformation config (include/exclude, type coercion, redaction, key rewrites); omitted means extraction is emitted unchanged")
+
+// Rule is evaluated against every etcd key. The first rule whose Include
+// glob matches (or that has no Include, acting as a catch-all) applies; its
+// Exclude, Type, Redact, and StripPrefix settings govern the key.
+type Rule struct {
+	Include     []string `yaml:"include" json:"include"`
+	Exclude     []string `yaml:"exclude" json:"exclude"`
+	Type        string   `yaml:"type" json:"type"` // int|bool|json, default is a plain string
+	Redact      []string `yaml:"redact" json:"redact"`
+	StripPrefix string   `yaml:"strip_prefix" json:"strip_prefix"`
+
+	redactRe []*regexp.Regexp
+}
+
+// TransformConfig is the top-level -config document.
+type TransformConfig struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+func loadTransformConfig(configPath string) (*TransformConfig, error) {
+	if configPath == "" {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config %s: %s", configPath, err.Error())
+	}
+
+	cfg := &TransformConfig{}
+	if strings.HasSuffix(configPath, ".json") {
+		err = json.Unmarshal(buf, cfg)
+	} else {
+		err = yaml.Unmarshal(buf, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse config %s: %s", configPath, err.Error())
+	}
+
+	for i := range cfg.Rules {
+		for _, p := range cfg.Rules[i].Redact {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redact pattern %q: %s", p, err.Error())
+			}
+			cfg.Rules[i].redactRe = append(cfg.Rules[i].redactRe, re)
+		}
+	}
+
+	return cfg, nil
+}
+
+// transformKey resolves the rule that applies to key, if any, and returns
+// the (possibly rewritten) key to store it under. keep is false if the key
+// should be dropped entirely.
+func transformKey(cfg *TransformConfig, key string) (outKey string, rule *Rule, keep bool) {
+	if cfg == nil {
+		return key, nil, true
+	}
+
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if len(r.Include) > 0 && !matchesAny(r.Include, key) {
+			continue
+		}
+		if matchesAny(r.Exclude, key) {
+			return "", nil, false
+		}
+
+		outKey := key
+		if r.StripPrefix != "" {
+			outKey = strings.TrimPrefix(key, r.StripPrefix)
+		}
+		// Re-normalize to the canonical "/a/b/c" form (a single leading
+		// slash, no trailing or doubled slashes) so outKey stays in sync
+		// with fullKey(), which diffNode uses to look up revisions.
+		outKey = fullKey(segmentsOf(outKey))
+		return outKey, r, true
+	}
+
+	return key, nil, true
+}
+
+// transformValue applies rule's type coercion and redaction to a raw etcd
+// value. rule may be nil, in which case the value is stored as-is.
+func transformValue(rule *Rule, raw []byte) interface{} {
+	if rule == nil {
+		return string(raw)
+	}
+
+	var val interface{}
+	switch rule.Type {
+	case "int":
+		if n, err := strconv.ParseInt(string(raw), 10, 64); err == nil {
+			val = n
+		} else {
+			val = string(raw)
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(string(raw)); err == nil {
+			val = b
+		} else {
+			val = string(raw)
+		}
+	case "json":
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err == nil {
+			val = v
+		} else {
+			val = string(raw)
+		}
+	default:
+		val = string(raw)
+	}
+
+	for _, re := range rule.redactRe {
+		if re.MatchString(string(raw)) {
+			return "***"
+		}
+	}
+	return val
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if matchGlob(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches key against pattern segment by segment. "**" matches
+// zero or more whole segments; any other segment is matched with
+// path.Match, so a single "*" matches within one segment only.
+func matchGlob(pattern, key string) bool {
+	return matchSegments(splitPath(pattern), splitPath(key))
+}
+
+func matchSegments(pat, key []string) bool {
+	if len(pat) == 0 {
+		return len(key) == 0
+	}
+
+	if pat[0] == "**" {
+		if matchSegments(pat[1:], key) {
+			return true
+		}
+		return len(key) > 0 && matchSegments(pat, key[1:])
+	}
+
+	if len(key) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], key[0]); !ok {
+		return false
+	}
+	return matchSegments(pat[1:], key[1:])
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestTransformKey(t *testing.T) {
+	cfg := &TransformConfig{
+		Rules: []Rule{
+			{Include: []string{"/secrets/**"}, Exclude: []string{"/secrets/public/**"}},
+			{Include: []string{"/services/**"}, StripPrefix: "/services/"},
+			{Include: []string{"/services/**"}, StripPrefix: "/services"},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		key      string
+		wantKey  string
+		wantKeep bool
+	}{
+		{
+			name:     "no rule matches, key passes through unchanged",
+			key:      "/other/x",
+			wantKey:  "/other/x",
+			wantKeep: true,
+		},
+		{
+			name:     "excluded by a later clause on the matching rule",
+			key:      "/secrets/public/a",
+			wantKeep: false,
+		},
+		{
+			name:     "included and kept",
+			key:      "/secrets/db/password",
+			wantKey:  "/secrets/db/password",
+			wantKeep: true,
+		},
+		{
+			name:     "strip_prefix yields a canonical leading-slash key",
+			key:      "/services/x/y",
+			wantKey:  "/x/y",
+			wantKeep: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			outKey, _, keep := transformKey(cfg, tc.key)
+			if keep != tc.wantKeep {
+				t.Fatalf("keep = %v, want %v", keep, tc.wantKeep)
+			}
+			if !keep {
+				return
+			}
+			if outKey != tc.wantKey {
+				t.Errorf("outKey = %q, want %q", outKey, tc.wantKey)
+			}
+		})
+	}
+}
+
+// TestTransformKeyStripPrefixMatchesFullKey guards the bug where a
+// strip_prefix rule produced an outKey that didn't match the canonical form
+// fullKey() builds from the same path, which made diffNode's revisions
+// lookups silently miss.
+func TestTransformKeyStripPrefixMatchesFullKey(t *testing.T) {
+	cfg := &TransformConfig{
+		Rules: []Rule{
+			{Include: []string{"/services/**"}, StripPrefix: "/services/x/"},
+		},
+	}
+
+	outKey, _, keep := transformKey(cfg, "/services/x/y")
+	if !keep {
+		t.Fatal("expected key to be kept")
+	}
+
+	want := fullKey(segmentsOf(outKey))
+	if outKey != want {
+		t.Errorf("outKey = %q is not in canonical form, fullKey(segmentsOf(outKey)) = %q", outKey, want)
+	}
+}